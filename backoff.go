@@ -0,0 +1,56 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// backoffFactor and backoffJitter mirror the defaults used by gRPC's
+// exponential backoff (factor ~1.6, jitter ~0.2).
+const (
+	backoffFactor = 1.6
+	backoffJitter = 0.2
+)
+
+// backoff computes a gRPC-style exponential backoff delay with jitter from a
+// consecutive-failure count. It is reset on the first success after a run of
+// failures.
+type backoff struct {
+	base  time.Duration
+	max   time.Duration
+	fails int
+}
+
+func newBackoff(base, max time.Duration) *backoff {
+	return &backoff{base: base, max: max}
+}
+
+// onSuccess resets the failure streak so the next delay() call returns 0.
+func (b *backoff) onSuccess() {
+	b.fails = 0
+}
+
+// onFailure records a failure, steepening the next delay.
+func (b *backoff) onFailure() {
+	b.fails++
+}
+
+// delay returns how long to wait before the next request given the current
+// failure streak: baseDelay * factor^fails, capped at max, with +/-jitter
+// applied. It returns 0 while there is no failure streak.
+func (b *backoff) delay() time.Duration {
+	if b.fails == 0 {
+		return 0
+	}
+	d := float64(b.base) * math.Pow(backoffFactor, float64(b.fails))
+	if d > float64(b.max) {
+		d = float64(b.max)
+	}
+	spread := d * backoffJitter
+	d = d - spread + rand.Float64()*2*spread
+	if d < 0 {
+		d = 0
+	}
+	return time.Duration(d)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// logFormatJSON switches the event logging below from the existing
+// human-readable/emoji lines to one structured JSON record per
+// request/connection event, suitable for feeding into analysis tools.
+const logFormatJSON = "json"
+
+func jsonLogging() bool {
+	return *logFormatArg == logFormatJSON
+}
+
+// logRecord is one structured request or connection event, emitted as a
+// single JSON line when -log-format=json.
+type logRecord struct {
+	Timestamp  time.Time `json:"timestamp"`
+	Worker     int       `json:"worker"`
+	Event      string    `json:"event"` // "request" or "connection"
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	VercelID   string    `json:"x_vercel_id,omitempty"`
+	Status     int       `json:"status,omitempty"`
+	DurationMS float64   `json:"duration_ms,omitempty"`
+	Bytes      int64     `json:"bytes,omitempty"`
+	Err        string    `json:"err,omitempty"`
+	DNSMS      float64   `json:"dns_ms,omitempty"`
+	ConnectMS  float64   `json:"connect_ms,omitempty"`
+	TLSMS      float64   `json:"tls_ms,omitempty"`
+	TTFBMS     float64   `json:"ttfb_ms,omitempty"`
+	ConnReused bool      `json:"conn_reused,omitempty"`
+}
+
+func emitJSON(rec logRecord) {
+	rec.Timestamp = time.Now()
+	b, err := json.Marshal(rec)
+	if err != nil {
+		fmt.Printf("log: failed to marshal record: %v\n", err)
+		return
+	}
+	fmt.Println(string(b))
+}
+
+// logRequestEvent reports one completed (or failed) measurement request,
+// either as the existing emoji line or, under -log-format=json, as a single
+// structured record carrying the httptrace phase timings alongside it.
+func logRequestEvent(workerID int, remoteAddr, vercelID string, status int, duration time.Duration, bytes int64, err error, trace *requestTrace) {
+	if !jsonLogging() {
+		return
+	}
+	rec := logRecord{
+		Worker:     workerID,
+		Event:      "request",
+		RemoteAddr: remoteAddr,
+		VercelID:   vercelID,
+		Status:     status,
+		DurationMS: float64(duration.Microseconds()) / 1000,
+		Bytes:      bytes,
+	}
+	if err != nil {
+		rec.Err = err.Error()
+	}
+	if trace != nil {
+		if !trace.dnsDone.IsZero() {
+			rec.DNSMS = millis(trace.dnsDone.Sub(trace.dnsStart))
+		}
+		if !trace.connectDone.IsZero() {
+			rec.ConnectMS = millis(trace.connectDone.Sub(trace.connectStart))
+		}
+		if !trace.tlsDone.IsZero() {
+			rec.TLSMS = millis(trace.tlsDone.Sub(trace.tlsStart))
+		}
+		if !trace.firstByte.IsZero() && !trace.wroteRequest.IsZero() {
+			rec.TTFBMS = millis(trace.firstByte.Sub(trace.wroteRequest))
+		}
+		rec.ConnReused = trace.reused
+	}
+	emitJSON(rec)
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// logConnEvent reports a connection lifecycle event ("connection" event,
+// opened or closed) under -log-format=json.
+func logConnEvent(workerID int, remoteAddr string, lifetimeMS float64, bytes int64) {
+	if !jsonLogging() {
+		return
+	}
+	emitJSON(logRecord{
+		Worker:     workerID,
+		Event:      "connection",
+		RemoteAddr: remoteAddr,
+		DurationMS: lifetimeMS,
+		Bytes:      bytes,
+	})
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "monitor_requests_total",
+		Help: "Total HTTP requests made, labeled by worker and status code.",
+	}, []string{"worker", "status"})
+
+	bytesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "monitor_response_bytes_total",
+		Help: "Total response bytes read, labeled by worker.",
+	}, []string{"worker"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "monitor_request_duration_seconds",
+		Help:    "End-to-end request duration.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"worker"})
+
+	connectDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "monitor_connect_duration_seconds",
+		Help:    "Time taken to establish a new pooled connection.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"worker"})
+
+	connLifetime = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "monitor_connection_lifetime_seconds",
+		Help:    "How long a pooled connection stayed open before it was closed.",
+		Buckets: []float64{1, 5, 15, 30, 60, 120, 300, 600},
+	}, []string{"worker"})
+)
+
+func init() {
+	prometheus.MustRegister(requestsTotal, bytesTotal, requestDuration, connectDuration, connLifetime)
+}
+
+func recordRequestMetrics(workerID int, statusCode int, duration time.Duration, bytes int64) {
+	worker := strconv.Itoa(workerID)
+	requestsTotal.WithLabelValues(worker, strconv.Itoa(statusCode)).Inc()
+	bytesTotal.WithLabelValues(worker).Add(float64(bytes))
+	requestDuration.WithLabelValues(worker).Observe(duration.Seconds())
+}
+
+func recordConnectMetrics(workerID int, duration time.Duration) {
+	connectDuration.WithLabelValues(strconv.Itoa(workerID)).Observe(duration.Seconds())
+}
+
+func recordConnLifetimeMetrics(workerID int, lifetime time.Duration) {
+	connLifetime.WithLabelValues(strconv.Itoa(workerID)).Observe(lifetime.Seconds())
+}
+
+// startMetricsServer exposes Prometheus metrics at addr/metrics until ctx is
+// cancelled.
+func startMetricsServer(ctx context.Context, addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	srv := &http.Server{Addr: addr, Handler: mux}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	fmt.Printf("Metrics server listening on http://%s/metrics\n", addr)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		fmt.Printf("metrics server error: %v\n", err)
+	}
+}
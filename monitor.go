@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"io"
 	"net"
@@ -9,21 +10,13 @@ import (
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
-)
-
-// connWrapper wraps a net.Conn to detect when it's closed
-type connWrapper struct {
-	net.Conn
-	addr   string
-	prefix string
-}
 
-func (c *connWrapper) Close() error {
-	fmt.Printf("\n%s 🔌 CONNECTION CLOSED to %s", c.prefix, c.addr)
-	return c.Conn.Close()
-}
+	"golang.org/x/time/rate"
+)
 
 const (
 	// Hard-coded URLs
@@ -31,119 +24,320 @@ const (
 	hostOverride = "alias-icn1.vercel.com"                           // IP/hostname to connect to instead of DNS resolution
 
 	// Configuration
-	requestInterval = 1 * time.Second
-	workerOffset    = 147 * time.Millisecond
-	requestTimeout  = 10 * time.Second
+	workerOffset   = 147 * time.Millisecond
+	requestTimeout = 10 * time.Second
+	hammerTimeout  = 5 * time.Second // grace period for in-flight requests once shutdown starts
+)
+
+// listenFDsEnv/listenFDsNamesEnv mirror systemd's socket-activation env vars so a
+// re-exec'd child can tell which inherited fds belong to which worker/slot.
+const (
+	listenFDsEnv      = "MONITOR_LISTEN_FDS"
+	listenFDsNamesEnv = "MONITOR_LISTEN_FDS_NAMES"
+	listenFDsStartFD  = 3 // fd 0,1,2 are stdin/stdout/stderr
+)
+
+var (
+	poolSizeFlag    = flag.Int("pool-size", 1, "number of persistent connections to keep per worker")
+	dialStrategyArg = flag.String("dial-strategy", "override", "connection dial strategy: override, round-robin, or pin-fastest")
+	dialIPsArg      = flag.String("dial-ips", "", "comma-separated override IPs to use with -dial-strategy=round-robin")
+	healthInterval  = flag.Duration("health-check-interval", 30*time.Second, "how often to probe idle connections; 0 disables health checks")
+
+	qpsFlag        = flag.Float64("qps", 1, "steady-state requests per second, per worker")
+	burstFlag      = flag.Int("burst", 1, "burst size allowed above the steady-state rate, per worker")
+	backoffBaseArg = flag.Duration("backoff-base", 500*time.Millisecond, "base delay for the exponential backoff applied after a failed/non-2xx request")
+	backoffMaxArg  = flag.Duration("backoff-max", 30*time.Second, "cap on the exponential backoff delay")
+
+	metricsAddrArg = flag.String("metrics-addr", "", "if set, serve Prometheus metrics at this address (e.g. :9090)")
+	logFormatArg   = flag.String("log-format", "text", "request/connection event log format: text or json")
+
+	protoArg = flag.String("proto", "h1", "transport protocol: h1, h2, h2c, or h3")
 )
 
+// workerState tracks the pieces of a running worker that the shutdown/restart
+// coordinator needs: its connection pool (to force-close idle connections and
+// to hand live connections to a re-exec'd child).
+type workerState struct {
+	id   int
+	pool *ConnPool
+}
+
 func main() {
-	// Parse command line arguments
+	flag.Parse()
+
 	numGoroutines := 1
-	if len(os.Args) > 1 {
-		if n, err := strconv.Atoi(os.Args[1]); err == nil && n > 0 {
+	if flag.NArg() > 0 {
+		if n, err := strconv.Atoi(flag.Arg(0)); err == nil && n > 0 {
 			numGoroutines = n
 		} else {
-			fmt.Printf("Invalid number of goroutines: %s. Using default value of 1.\n", os.Args[1])
+			fmt.Printf("Invalid number of goroutines: %s. Using default value of 1.\n", flag.Arg(0))
 		}
 	}
 
-	fmt.Printf("Starting HTTP monitor for %s using host override %s with %d goroutine(s)\n",
-		targetURL, hostOverride, numGoroutines)
-	fmt.Println("Press Ctrl+C to stop...")
+	strategy, err := parseDialStrategy(*dialStrategyArg)
+	if err != nil {
+		fmt.Printf("%v. Using default strategy of override.\n", err)
+		strategy = DialStrategyOverride
+	}
+	var dialIPs []string
+	for _, ip := range strings.Split(*dialIPsArg, ",") {
+		if ip = strings.TrimSpace(ip); ip != "" {
+			dialIPs = append(dialIPs, ip)
+		}
+	}
 
-	// Set up graceful shutdown
-	stopChan := make(chan os.Signal, 1)
-	signal.Notify(stopChan, os.Interrupt, syscall.SIGTERM)
+	proto, err := parseProto(*protoArg)
+	if err != nil {
+		fmt.Printf("%v. Using default protocol of h1.\n", err)
+		proto = "h1"
+	} else if proto == "h2c" {
+		// h2c speaks HTTP/2 in plaintext; targetURL is hardcoded to https, so
+		// there's no cleartext listener to actually negotiate it against.
+		fmt.Printf("h2c requires a cleartext target, but %s is https. Using default protocol of h1.\n", targetURL)
+		proto = "h1"
+	}
+
+	fmt.Printf("Starting HTTP monitor for %s using host override %s with %d goroutine(s), pool size %d, dial strategy %s, proto %s\n",
+		targetURL, hostOverride, numGoroutines, *poolSizeFlag, strategy, proto)
+	fmt.Println("Press Ctrl+C to stop (SIGHUP/SIGUSR2 to restart in place)...")
+
+	inherited := adoptInheritedConns()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	workers := make([]*workerState, numGoroutines)
+
+	if *metricsAddrArg != "" {
+		go startMetricsServer(ctx, *metricsAddrArg)
+	}
+
+	// Set up graceful shutdown / restart
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR2)
 
 	// Start worker goroutines
 	for i := 0; i < numGoroutines; i++ {
 		time.Sleep(workerOffset) // Stagger start times
-		go func(workerID int) {
-			runWorker(workerID, stopChan)
-		}(i + 1)
+		workerID := i + 1
+		prefix := fmt.Sprintf("[G%d] ", workerID)
+		w := &workerState{
+			id:   workerID,
+			pool: NewConnPool(prefix, workerID, *poolSizeFlag, strategy, dialIPs, *healthInterval, proto, inherited[workerID]),
+		}
+		workers[i] = w
+		wg.Add(1)
+		go func(w *workerState) {
+			defer wg.Done()
+			runWorker(ctx, w)
+		}(w)
 	}
 
-	// Wait for shutdown signal, bail immediately
-	<-stopChan
-	fmt.Println("\nShutting down...")
+	// Wait for a signal, then shut down or restart
+	sig := <-sigChan
+	switch sig {
+	case syscall.SIGHUP, syscall.SIGUSR2:
+		fmt.Printf("\nReceived %s, restarting in place...\n", sig)
+		cancel()
+		waitWithHammer(&wg, workers, hammerTimeout)
+		restartInPlace(workers)
+	default:
+		fmt.Println("\nShutting down...")
+		cancel()
+		waitWithHammer(&wg, workers, hammerTimeout)
+	}
 }
 
-// runWorker runs a single worker goroutine that makes periodic HTTP requests
-func runWorker(workerID int, stopChan <-chan os.Signal) {
-	prefix := fmt.Sprintf("[G%d] ", workerID)
-	client := createHTTPClient(prefix)
+// waitWithHammer waits for all workers to return, but after hammerTimeout it
+// force-closes each worker's idle connections so anything still stuck in a
+// request doesn't block process exit forever.
+func waitWithHammer(wg *sync.WaitGroup, workers []*workerState, hammer time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		fmt.Println("All workers stopped cleanly.")
+	case <-time.After(hammer):
+		fmt.Printf("Hammer timeout (%s) reached; closing idle connections to force outstanding requests out...\n", hammer)
+		for _, w := range workers {
+			w.pool.CloseIdle()
+		}
+		<-done
+	}
+}
+
+// restartInPlace re-execs the current binary with the same arguments, handing
+// each worker's live connections to the child via ExtraFiles so their
+// keep-alive connections survive the binary upgrade instead of being
+// redialed.
+func restartInPlace(workers []*workerState) {
+	var files []*os.File
+	var names []string
+	for _, w := range workers {
+		for slotID, conn := range w.pool.Conns() {
+			tcpConn, ok := conn.(*net.TCPConn)
+			if !ok {
+				continue
+			}
+			f, err := tcpConn.File()
+			if err != nil {
+				fmt.Printf("restart: could not extract fd for worker %d slot %d: %v\n", w.id, slotID, err)
+				continue
+			}
+			files = append(files, f)
+			names = append(names, fmt.Sprintf("%d:%d", w.id, slotID))
+		}
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		fmt.Printf("restart: could not resolve executable path: %v\n", err)
+		return
+	}
 
-	// Create a ticker for periodic requests
-	ticker := time.NewTicker(requestInterval)
-	defer ticker.Stop()
+	env := append(os.Environ(),
+		fmt.Sprintf("%s=%d", listenFDsEnv, len(files)),
+		fmt.Sprintf("%s=%s", listenFDsNamesEnv, strings.Join(names, ":")),
+	)
+	procFiles := append([]*os.File{os.Stdin, os.Stdout, os.Stderr}, files...)
 
-	fmt.Printf("%s Worker %d started\n", prefix, workerID)
+	proc, err := os.StartProcess(exe, os.Args, &os.ProcAttr{
+		Env:   env,
+		Files: procFiles,
+	})
+	if err != nil {
+		fmt.Printf("restart: failed to re-exec: %v\n", err)
+		return
+	}
+	fmt.Printf("restart: re-exec'd as pid %d carrying %d connection(s)\n", proc.Pid, len(files))
+}
 
-	// Make initial request
-	makeRequest(client, prefix)
+// adoptInheritedConns reads the LISTEN_FDS-style env vars left by a parent
+// that re-exec'd us and returns any inherited connections keyed by worker ID
+// and then by slot ID.
+func adoptInheritedConns() map[int]map[int]net.Conn {
+	inherited := map[int]map[int]net.Conn{}
 
-	// Main loop
-	for {
-		select {
-		case <-ticker.C:
-			makeRequest(client, prefix)
-		case <-stopChan:
-			fmt.Printf("%s Worker %d stopping...\n", prefix, workerID)
-			return
+	count, err := strconv.Atoi(os.Getenv(listenFDsEnv))
+	if err != nil || count <= 0 {
+		return inherited
+	}
+	names := strings.Split(os.Getenv(listenFDsNamesEnv), ":")
+
+	for i := 0; i < count && i < len(names); i++ {
+		parts := strings.SplitN(names[i], ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		workerID, err1 := strconv.Atoi(parts[0])
+		slotID, err2 := strconv.Atoi(parts[1])
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		fd := listenFDsStartFD + i
+		f := os.NewFile(uintptr(fd), fmt.Sprintf("inherited-conn-%d-%d", workerID, slotID))
+		conn, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			fmt.Printf("restart: could not adopt inherited fd for worker %d slot %d: %v\n", workerID, slotID, err)
+			continue
+		}
+		if inherited[workerID] == nil {
+			inherited[workerID] = map[int]net.Conn{}
 		}
+		inherited[workerID][slotID] = conn
 	}
+	return inherited
 }
 
-func createHTTPClient(prefix string) *http.Client {
-	// Create a custom transport with host override and connection reuse
-	transport := &http.Transport{
-		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-			if hostOverride != "" {
-				_, port, err := net.SplitHostPort(addr)
-				if err != nil {
-					return nil, err
-				}
-				addr = net.JoinHostPort(hostOverride, port)
-			}
-			d := &net.Dialer{
-				Timeout:   10 * time.Second,
-				KeepAlive: 30 * time.Second, // Keep-alive for 30 seconds
+// runWorker runs a single worker goroutine that makes HTTP requests paced by
+// a rate limiter until ctx is cancelled. On a failed or non-2xx request it
+// composes an exponential backoff with the steady-state rate, topping up the
+// limiter's wait with only the excess backoff delay, so the effective
+// interval between requests becomes
+// max(1/qps, backoffBase*factor^consecutiveFailures*(1±jitter)) until a
+// request succeeds again.
+func runWorker(ctx context.Context, w *workerState) {
+	prefix := fmt.Sprintf("[G%d] ", w.id)
+	go w.pool.RunHealthChecks(ctx)
+
+	limiter := rate.NewLimiter(rate.Limit(*qpsFlag), *burstFlag)
+	bo := newBackoff(*backoffBaseArg, *backoffMaxArg)
+
+	fmt.Printf("%s Worker %d started\n", prefix, w.id)
+
+	for {
+		if err := limiter.Wait(ctx); err != nil {
+			fmt.Printf("%s Worker %d stopping...\n", prefix, w.id)
+			return
+		}
+		var minInterval time.Duration
+		if *qpsFlag > 0 {
+			minInterval = time.Duration(float64(time.Second) / *qpsFlag)
+		}
+		if d := bo.delay(); d > minInterval {
+			extra := d - minInterval
+			if !jsonLogging() {
+				fmt.Printf("\n%s backing off %s after %d consecutive failure(s)", prefix, d.Round(time.Millisecond), bo.fails)
 			}
-			conn, err := d.DialContext(ctx, "tcp4", addr)
-			if err == nil {
-				fmt.Printf("\n%s 🔗 NEW CONNECTION established to %s", prefix, addr)
-				// Wrap the connection to detect when it's closed
-				return &connWrapper{Conn: conn, addr: addr, prefix: prefix}, nil
+			select {
+			case <-time.After(extra):
+			case <-ctx.Done():
+				fmt.Printf("%s Worker %d stopping...\n", prefix, w.id)
+				return
 			}
-			return conn, err
-		},
-		// Connection pooling and keep-alive settings
-		MaxIdleConns:        1, // Limit to 1 idle connection total
-		MaxIdleConnsPerHost: 1, // Limit to 1 idle connection per host
-		MaxConnsPerHost:     1,
-		IdleConnTimeout:     10 * time.Second, // Keep connection alive for 90 seconds
-		DisableKeepAlives:   false,            // Enable keep-alives (default, but explicit)
-		// Optional: Disable compression to reduce overhead if not needed
-		// DisableCompression: true,
-	}
+		}
 
-	return &http.Client{
-		Transport: transport,
+		if makeRequest(ctx, w.pool, prefix) {
+			bo.onSuccess()
+		} else {
+			bo.onFailure()
+		}
 	}
 }
 
-func makeRequest(client *http.Client, prefix string) {
+// makeRequest issues one measurement request and reports whether it
+// succeeded (a response with a 2xx status), which drives the backoff above.
+// It records Prometheus metrics for every attempt and, under
+// -log-format=json, emits a structured record instead of the default emoji
+// line.
+func makeRequest(ctx context.Context, pool *ConnPool, prefix string) bool {
 	startTime := time.Now()
 	timestamp := startTime.Format("15:04:05.000")
-	fmt.Printf("\n%s [%s] Start", prefix, timestamp)
+	if !jsonLogging() {
+		fmt.Printf("\n%s [%s] Start", prefix, timestamp)
+	}
+
+	reqCtx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	trace := &requestTrace{}
+	reqCtx = withRequestTrace(reqCtx, trace)
 
-	resp, err := client.Get(targetURL)
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, targetURL, nil)
+	if err != nil {
+		if !jsonLogging() {
+			fmt.Printf("\n%s [%s] Error building request: %v", prefix, timestamp, err)
+		}
+		return false
+	}
+
+	pr := pool.Next()
+	resp, err := pr.Client.Do(req)
 	endTime := time.Now()
 	endTimestamp := endTime.Format("15:04:05.000")
 
 	if err != nil {
-		fmt.Printf("\n%s [%s] Error: %v", prefix, endTimestamp, err)
-		return
+		recordRequestMetrics(pool.workerID, 0, endTime.Sub(startTime), 0)
+		if jsonLogging() {
+			logRequestEvent(pool.workerID, hostOverride, "", 0, endTime.Sub(startTime), 0, err, trace)
+		} else {
+			fmt.Printf("\n%s [%s] Error: %v", prefix, endTimestamp, err)
+		}
+		return false
 	}
 	defer resp.Body.Close()
 
@@ -155,6 +349,18 @@ func makeRequest(client *http.Client, prefix string) {
 
 	// Drain the response body to allow for connection reuse and count bytes
 	bytesRead, _ := io.Copy(io.Discard, resp.Body)
+	pr.Done()
 	duration := endTime.Sub(startTime).Round(time.Millisecond)
-	fmt.Printf("\n%s [%s] End - Status: %d, Size: %d bytes, Duration: %s, x-vercel-id: %s", prefix, endTimestamp, resp.StatusCode, bytesRead, duration, vercelID)
+	recordRequestMetrics(pool.workerID, resp.StatusCode, duration, bytesRead)
+	if jsonLogging() {
+		logRequestEvent(pool.workerID, hostOverride, vercelID, resp.StatusCode, duration, bytesRead, nil, trace)
+	} else {
+		line := fmt.Sprintf("\n%s [%s] End - Status: %d, Size: %d bytes, Duration: %s, x-vercel-id: %s",
+			prefix, endTimestamp, resp.StatusCode, bytesRead, duration, vercelID)
+		if summary := trace.summary(); summary != "" {
+			line += ", " + summary
+		}
+		fmt.Print(line)
+	}
+	return resp.StatusCode >= 200 && resp.StatusCode < 300
 }
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DialStrategy selects how a ConnPool resolves the address it actually dials.
+type DialStrategy int
+
+const (
+	// DialStrategyOverride dials hostOverride directly, unchanged from the
+	// tool's original hard-coded behavior.
+	DialStrategyOverride DialStrategy = iota
+	// DialStrategyRoundRobin cycles through a fixed list of override IPs,
+	// one per new connection, so load spreads across several edge POPs.
+	DialStrategyRoundRobin
+	// DialStrategyPinFastest resolves the original host's A records and
+	// pins every connection in the pool to whichever one answered first.
+	DialStrategyPinFastest
+)
+
+func (s DialStrategy) String() string {
+	switch s {
+	case DialStrategyRoundRobin:
+		return "round-robin"
+	case DialStrategyPinFastest:
+		return "pin-fastest"
+	default:
+		return "override"
+	}
+}
+
+func parseDialStrategy(s string) (DialStrategy, error) {
+	switch s {
+	case "", "override":
+		return DialStrategyOverride, nil
+	case "round-robin":
+		return DialStrategyRoundRobin, nil
+	case "pin-fastest":
+		return DialStrategyPinFastest, nil
+	default:
+		return 0, fmt.Errorf("unknown dial strategy %q (want override, round-robin, or pin-fastest)", s)
+	}
+}
+
+// connStats is a point-in-time snapshot of a single pooled connection's
+// counters, suitable for printing or exporting.
+type connStats struct {
+	slotID   int
+	connID   int
+	addr     string
+	bytes    int64
+	requests int64
+	errors   int64
+	lastUsed time.Time
+	age      time.Duration
+}
+
+// poolConn wraps a dialed net.Conn with the bookkeeping ConnPool needs to
+// report per-connection statistics and to evict it after a failed health
+// check.
+type poolConn struct {
+	net.Conn
+	pool      *ConnPool
+	slot      *poolSlot
+	id        int
+	addr      string
+	createdAt time.Time
+
+	bytes    int64 // atomic
+	requests int64 // atomic
+	errors   int64 // atomic
+
+	mu       sync.Mutex
+	lastUsed time.Time
+	closed   bool
+}
+
+func (c *poolConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.bytes, int64(n))
+	c.mu.Lock()
+	c.lastUsed = time.Now()
+	c.mu.Unlock()
+	if err != nil && err != io.EOF {
+		atomic.AddInt64(&c.errors, 1)
+	}
+	return n, err
+}
+
+func (c *poolConn) Close() error {
+	c.mu.Lock()
+	alreadyClosed := c.closed
+	c.closed = true
+	c.mu.Unlock()
+	if !alreadyClosed {
+		lifetime := time.Since(c.createdAt)
+		recordConnLifetimeMetrics(c.pool.workerID, lifetime)
+		if jsonLogging() {
+			logConnEvent(c.pool.workerID, c.addr, float64(lifetime.Milliseconds()), atomic.LoadInt64(&c.bytes))
+		} else {
+			fmt.Printf("\n%s 🔌 CONNECTION #%d (slot %d) CLOSED to %s (requests=%d, bytes=%d, errors=%d)",
+				c.pool.prefix, c.id, c.slot.id, c.addr,
+				atomic.LoadInt64(&c.requests), atomic.LoadInt64(&c.bytes), atomic.LoadInt64(&c.errors))
+		}
+	}
+	return c.Conn.Close()
+}
+
+func (c *poolConn) stats() connStats {
+	c.mu.Lock()
+	lastUsed := c.lastUsed
+	c.mu.Unlock()
+	return connStats{
+		slotID:   c.slot.id,
+		connID:   c.id,
+		addr:     c.addr,
+		bytes:    atomic.LoadInt64(&c.bytes),
+		requests: atomic.LoadInt64(&c.requests),
+		errors:   atomic.LoadInt64(&c.errors),
+		lastUsed: lastUsed,
+		age:      time.Since(c.createdAt),
+	}
+}
+
+// poolSlot owns exactly one persistent connection. Its Transport caps
+// MaxConnsPerHost at 1, so concurrent real requests and health-check probes
+// are serialized onto the same physical connection by net/http itself
+// instead of racing each other.
+type poolSlot struct {
+	id     int
+	pool   *ConnPool
+	client *http.Client
+
+	mu   sync.Mutex
+	conn *poolConn
+}
+
+func (s *poolSlot) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	s.pool.mu.Lock()
+	inherited := s.pool.inherited[s.id]
+	delete(s.pool.inherited, s.id)
+	s.pool.mu.Unlock()
+
+	if inherited != nil {
+		pc := s.newPoolConn(inherited, addr)
+		if !jsonLogging() {
+			fmt.Printf("\n%s 🔗 ADOPTED CONNECTION #%d (slot %d) from parent process to %s", s.pool.prefix, pc.id, s.id, addr)
+		}
+		return pc, nil
+	}
+
+	target, err := s.pool.resolveTarget(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	dialStart := time.Now()
+	conn, err := s.pool.dialer.DialContext(ctx, "tcp4", target)
+	if err != nil {
+		return nil, err
+	}
+	recordConnectMetrics(s.pool.workerID, time.Since(dialStart))
+	pc := s.newPoolConn(conn, target)
+	if !jsonLogging() {
+		fmt.Printf("\n%s 🔗 NEW CONNECTION #%d (slot %d) established to %s (strategy=%s)", s.pool.prefix, pc.id, s.id, target, s.pool.strategy)
+	}
+	return pc, nil
+}
+
+func (s *poolSlot) newPoolConn(conn net.Conn, addr string) *poolConn {
+	pc := &poolConn{
+		Conn:      conn,
+		pool:      s.pool,
+		slot:      s,
+		id:        int(atomic.AddInt32(&s.pool.nextID, 1)),
+		addr:      addr,
+		createdAt: time.Now(),
+		lastUsed:  time.Now(),
+	}
+	s.mu.Lock()
+	s.conn = pc
+	s.mu.Unlock()
+	return pc
+}
+
+// PooledRequest is a single checked-out use of a pool slot: the client to
+// issue the request with, plus a Done() to record that it completed so the
+// slot's per-connection stats stay accurate.
+type PooledRequest struct {
+	Client *http.Client
+	slot   *poolSlot
+}
+
+// Done records that a request against this slot's connection completed.
+func (pr *PooledRequest) Done() {
+	pr.slot.mu.Lock()
+	conn := pr.slot.conn
+	pr.slot.mu.Unlock()
+	if conn != nil {
+		atomic.AddInt64(&conn.requests, 1)
+	}
+}
+
+// ConnPool manages a fixed-size set of persistent connections to the target
+// host, dialed according to a configurable DialStrategy, and periodically
+// health-checks idle connections so a degraded one doesn't silently keep
+// serving (and skewing) measurements.
+type ConnPool struct {
+	prefix   string
+	workerID int
+	strategy DialStrategy
+	ips      []string
+	dialer   *net.Dialer
+
+	healthInterval time.Duration
+
+	mu        sync.Mutex
+	rrIdx     int
+	slots     []*poolSlot
+	inherited map[int]net.Conn // slot ID -> connection inherited from a restart, consumed on first dial
+	nextID    int32
+}
+
+// NewConnPool creates a ConnPool of the given size for a single worker,
+// speaking the given protocol ("h1", "h2", "h2c", or "h3"). inherited, if
+// non-nil, hands specific slots a connection carried over from a
+// SIGHUP/SIGUSR2 restart instead of dialing fresh. ips is only consulted by
+// DialStrategyRoundRobin.
+func NewConnPool(prefix string, workerID int, size int, strategy DialStrategy, ips []string, healthInterval time.Duration, proto string, inherited map[int]net.Conn) *ConnPool {
+	if inherited == nil {
+		inherited = map[int]net.Conn{}
+	}
+	p := &ConnPool{
+		prefix:         prefix,
+		workerID:       workerID,
+		strategy:       strategy,
+		ips:            ips,
+		healthInterval: healthInterval,
+		inherited:      inherited,
+		dialer: &net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 30 * time.Second,
+		},
+	}
+	for i := 0; i < size; i++ {
+		slot := &poolSlot{id: i + 1, pool: p}
+		slot.client = &http.Client{Transport: slot.buildRoundTripper(proto)}
+		p.slots = append(p.slots, slot)
+	}
+	return p
+}
+
+// resolveTarget turns the address http.Transport wants to dial into the
+// address we actually connect to, per the pool's configured strategy.
+func (p *ConnPool) resolveTarget(ctx context.Context, addr string) (string, error) {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+
+	switch p.strategy {
+	case DialStrategyRoundRobin:
+		if len(p.ips) == 0 {
+			return addr, nil
+		}
+		p.mu.Lock()
+		ip := p.ips[p.rrIdx%len(p.ips)]
+		p.rrIdx++
+		p.mu.Unlock()
+		return net.JoinHostPort(ip, port), nil
+
+	case DialStrategyPinFastest:
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return "", err
+		}
+		ipAddrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil || len(ipAddrs) == 0 {
+			return addr, err
+		}
+		return net.JoinHostPort(raceFastestAddr(ctx, ipAddrs, port), port), nil
+
+	default: // DialStrategyOverride
+		if hostOverride == "" {
+			return addr, nil
+		}
+		return net.JoinHostPort(hostOverride, port), nil
+	}
+}
+
+// raceFastestAddr dials every candidate concurrently and returns the IP of
+// whichever one answers first, falling back to the first candidate if every
+// dial fails. Connections opened just to race are closed immediately; the
+// caller re-dials the winner for real use.
+// raceResult is one candidate's outcome in raceFastestAddr's dial race.
+type raceResult struct {
+	ip   string
+	conn net.Conn
+	err  error
+}
+
+func raceFastestAddr(ctx context.Context, ipAddrs []net.IPAddr, port string) string {
+	results := make(chan raceResult, len(ipAddrs))
+	d := &net.Dialer{Timeout: 3 * time.Second}
+	for _, ipAddr := range ipAddrs {
+		ip := ipAddr.String()
+		go func() {
+			conn, err := d.DialContext(ctx, "tcp4", net.JoinHostPort(ip, port))
+			results <- raceResult{ip: ip, conn: conn, err: err}
+		}()
+	}
+
+	fastest := ipAddrs[0].String()
+	for remaining := len(ipAddrs); remaining > 0; remaining-- {
+		r := <-results
+		if r.err != nil {
+			continue
+		}
+		fastest = r.ip
+		r.conn.Close()
+		if remaining > 1 {
+			go drainRaceResults(results, remaining-1)
+		}
+		break
+	}
+	return fastest
+}
+
+func drainRaceResults(results <-chan raceResult, n int) {
+	for i := 0; i < n; i++ {
+		if r := <-results; r.err == nil {
+			r.conn.Close()
+		}
+	}
+}
+
+// Next checks out the next slot in round-robin order for a real measurement
+// request.
+func (p *ConnPool) Next() *PooledRequest {
+	p.mu.Lock()
+	slot := p.slots[p.rrIdx%len(p.slots)]
+	p.rrIdx++
+	p.mu.Unlock()
+	return &PooledRequest{Client: slot.client, slot: slot}
+}
+
+// Stats returns a snapshot of every slot's current connection.
+func (p *ConnPool) Stats() []connStats {
+	stats := make([]connStats, 0, len(p.slots))
+	for _, s := range p.slots {
+		s.mu.Lock()
+		conn := s.conn
+		s.mu.Unlock()
+		if conn != nil {
+			stats = append(stats, conn.stats())
+		}
+	}
+	return stats
+}
+
+// CloseIdle force-closes every slot's idle connection, used by the shutdown
+// coordinator's hammer timeout.
+func (p *ConnPool) CloseIdle() {
+	for _, s := range p.slots {
+		if ic, ok := s.client.Transport.(idleCloser); ok {
+			ic.CloseIdleConnections()
+		}
+	}
+}
+
+// Conns returns the live connection for each slot that currently has one,
+// used to hand connections to a re-exec'd child on restart.
+func (p *ConnPool) Conns() map[int]net.Conn {
+	conns := map[int]net.Conn{}
+	for _, s := range p.slots {
+		s.mu.Lock()
+		conn := s.conn
+		s.mu.Unlock()
+		if conn != nil {
+			conns[s.id] = conn.Conn
+		}
+	}
+	return conns
+}
+
+// RunHealthChecks periodically issues a cheap HEAD request over every idle
+// pooled connection and evicts any that fail, until ctx is cancelled.
+func (p *ConnPool) RunHealthChecks(ctx context.Context) {
+	if p.healthInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(p.healthInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, s := range p.slots {
+				p.probeSlot(ctx, s)
+			}
+		}
+	}
+}
+
+// probeSlot issues a HEAD request through the slot's own client, relying on
+// MaxConnsPerHost: 1 to serialize it safely against any in-flight real
+// request on the same connection. A failure evicts just this connection.
+func (p *ConnPool) probeSlot(ctx context.Context, s *poolSlot) {
+	s.mu.Lock()
+	conn := s.conn
+	s.mu.Unlock()
+	if conn == nil {
+		return
+	}
+	conn.mu.Lock()
+	idleFor := time.Since(conn.lastUsed)
+	conn.mu.Unlock()
+	if idleFor < p.healthInterval {
+		return // served a real request recently enough, no need to probe
+	}
+
+	reqCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodHead, targetURL, nil)
+	if err != nil {
+		return
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		if !jsonLogging() {
+			fmt.Printf("\n%s ⚠️ health check failed for connection #%d (slot %d): %v, evicting", p.prefix, conn.id, s.id, err)
+		}
+		conn.Close() // logs/emits the "connection" record under -log-format=json
+		return
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	atomic.AddInt64(&conn.requests, 1)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2"
+)
+
+func parseProto(s string) (string, error) {
+	switch s {
+	case "":
+		return "h1", nil
+	case "h1", "h2", "h2c", "h3":
+		return s, nil
+	default:
+		return "", fmt.Errorf("unknown protocol %q (want h1, h2, h2c, or h3)", s)
+	}
+}
+
+// idleCloser is implemented by every RoundTripper we hand out
+// (*http.Transport and *http2.Transport); CloseIdle uses it to force-close
+// idle connections during the shutdown coordinator's hammer timeout.
+type idleCloser interface {
+	CloseIdleConnections()
+}
+
+// buildRoundTripper returns the http.RoundTripper for a single pool slot,
+// per the configured protocol. h1/h2/h2c dial through the slot's own
+// dialContext (preserving hostOverride and the pool's per-connection
+// bookkeeping); h3 dials QUIC directly since it runs over UDP, overriding
+// the remote addr itself.
+func (s *poolSlot) buildRoundTripper(proto string) http.RoundTripper {
+	switch proto {
+	case "h2":
+		t := &http.Transport{
+			DialContext:         s.dialContext,
+			MaxIdleConns:        1,
+			MaxIdleConnsPerHost: 1,
+			MaxConnsPerHost:     1,
+			IdleConnTimeout:     10 * time.Second,
+		}
+		if err := http2.ConfigureTransport(t); err != nil {
+			fmt.Printf("%s could not configure h2 transport: %v, falling back to h1\n", s.pool.prefix, err)
+		}
+		return t
+
+	case "h2c":
+		// http2.Transport speaks h2c directly over whatever DialTLSContext
+		// returns when AllowHTTP is set, so a plain TCP conn from
+		// dialContext works without ever doing a TLS handshake. This only
+		// behaves correctly against a request whose URL scheme is "http";
+		// main() refuses -proto=h2c for targetURL's hardcoded https scheme
+		// for exactly that reason, since dialClientConn calls DialTLSContext
+		// unconditionally regardless of scheme and a "https"-scheme request
+		// would otherwise write the HTTP/2 preface in plaintext to a server
+		// expecting a TLS ClientHello.
+		return &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return s.dialContext(ctx, network, addr)
+			},
+		}
+
+	case "h3":
+		// QUIC connections aren't net.Conn, so they bypass newPoolConn:
+		// h3 gets per-request tracing but not this pool's per-connection
+		// stats, health checks, or fd hand-off across a restart.
+		return &http3.RoundTripper{
+			Dial: func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
+				target := addr
+				if hostOverride != "" {
+					if _, port, err := net.SplitHostPort(addr); err == nil {
+						target = net.JoinHostPort(hostOverride, port)
+					}
+				}
+				udpAddr, err := net.ResolveUDPAddr("udp", target)
+				if err != nil {
+					return nil, err
+				}
+				return quic.DialAddrEarly(ctx, udpAddr.String(), tlsCfg, cfg)
+			},
+		}
+
+	default: // h1
+		return &http.Transport{
+			DialContext:         s.dialContext,
+			MaxIdleConns:        1,
+			MaxIdleConnsPerHost: 1,
+			MaxConnsPerHost:     1,
+			IdleConnTimeout:     10 * time.Second,
+		}
+	}
+}
+
+// requestTrace captures the per-phase timings of a single request via
+// httptrace.ClientTrace, so degradation that lives in DNS, TCP connect, or
+// the TLS handshake shows up separately from body-transfer time.
+type requestTrace struct {
+	dnsStart, dnsDone         time.Time
+	connectStart, connectDone time.Time
+	tlsStart, tlsDone         time.Time
+	gotConn                   time.Time
+	reused                    bool
+	wroteRequest              time.Time
+	firstByte                 time.Time
+}
+
+func withRequestTrace(ctx context.Context, rt *requestTrace) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSStart:          func(httptrace.DNSStartInfo) { rt.dnsStart = time.Now() },
+		DNSDone:           func(httptrace.DNSDoneInfo) { rt.dnsDone = time.Now() },
+		ConnectStart:      func(network, addr string) { rt.connectStart = time.Now() },
+		ConnectDone:       func(network, addr string, err error) { rt.connectDone = time.Now() },
+		TLSHandshakeStart: func() { rt.tlsStart = time.Now() },
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { rt.tlsDone = time.Now() },
+		GotConn: func(info httptrace.GotConnInfo) {
+			rt.gotConn = time.Now()
+			rt.reused = info.Reused
+		},
+		WroteRequest:         func(httptrace.WroteRequestInfo) { rt.wroteRequest = time.Now() },
+		GotFirstResponseByte: func() { rt.firstByte = time.Now() },
+	})
+}
+
+// summary renders the phases that actually fired (a reused connection skips
+// DNS/connect/TLS entirely) as "phase=duration" pairs for the human-readable
+// log line.
+func (rt *requestTrace) summary() string {
+	var parts []string
+	if !rt.dnsDone.IsZero() {
+		parts = append(parts, fmt.Sprintf("dns=%s", rt.dnsDone.Sub(rt.dnsStart).Round(time.Microsecond)))
+	}
+	if !rt.connectDone.IsZero() {
+		parts = append(parts, fmt.Sprintf("connect=%s", rt.connectDone.Sub(rt.connectStart).Round(time.Microsecond)))
+	}
+	if !rt.tlsDone.IsZero() {
+		parts = append(parts, fmt.Sprintf("tls=%s", rt.tlsDone.Sub(rt.tlsStart).Round(time.Microsecond)))
+	}
+	if !rt.gotConn.IsZero() {
+		parts = append(parts, fmt.Sprintf("got_conn=reused:%t", rt.reused))
+	}
+	if !rt.firstByte.IsZero() && !rt.wroteRequest.IsZero() {
+		parts = append(parts, fmt.Sprintf("ttfb=%s", rt.firstByte.Sub(rt.wroteRequest).Round(time.Microsecond)))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return strings.Join(parts, " ")
+}